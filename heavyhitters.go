@@ -0,0 +1,133 @@
+// heavyhitters.go
+package main
+
+import "sort"
+
+// userStats 是 Space-Saving 算法为每个被监控 key 维护的近似计数器：
+// count 是该 key 的（近似）出现次数上界，errorCount 是 5xx 响应的（近似）次数上界。
+type userStats struct {
+	count      uint64
+	errorCount uint64
+	sumResp    float64
+	respCount  uint64
+}
+
+// SpaceSaving 实现 Space-Saving / Misra-Gries 流式 heavy-hitters 算法：
+// 用至多 capacity 个监控槽位估计高基数 key（这里是 user_id）里请求量最大的那些，
+// 内存占用是 O(capacity)，与输入流的长度无关，代价是被监控 key 的计数是近似值
+// 而非精确值：它可能偏高，偏高量至多是该 key 被插入时继承的计数；未被监控的 key 没有计数。
+type SpaceSaving struct {
+	capacity int
+	stats    map[string]*userStats
+}
+
+// NewSpaceSaving 创建一个容量为 capacity 的 Space-Saving 计数器。
+func NewSpaceSaving(capacity int) *SpaceSaving {
+	return &SpaceSaving{
+		capacity: capacity,
+		stats:    make(map[string]*userStats, capacity),
+	}
+}
+
+// Observe 记录一次对 key 的访问。isError 表示这是否是一次 5xx 响应，
+// resp 是该请求的响应时间（可能为 nil）。调用方负责加锁。
+func (s *SpaceSaving) Observe(key string, isError bool, resp *float64) {
+	if st, ok := s.stats[key]; ok {
+		st.count++
+		if isError {
+			st.errorCount++
+		}
+		if resp != nil {
+			st.sumResp += *resp
+			st.respCount++
+		}
+		return
+	}
+
+	if len(s.stats) < s.capacity {
+		st := &userStats{count: 1}
+		if isError {
+			st.errorCount = 1
+		}
+		if resp != nil {
+			st.sumResp = *resp
+			st.respCount = 1
+		}
+		s.stats[key] = st
+		return
+	}
+
+	// 容量已满：淘汰计数最小的条目，新 key 继承它的计数加一。
+	// 新 key 的计数 minCount+1 是它真实出现次数的上界，至多偏高 minCount；
+	// 继承的 errorCount 同样是它 5xx 次数的上界，而继承的 sumResp/respCount 混入了
+	// 被淘汰 key 的响应时间，由此得出的平均响应时间只是近似值。
+	var evictKey string
+	var evicted *userStats
+	for k, st := range s.stats {
+		if evicted == nil || st.count < evicted.count {
+			evictKey = k
+			evicted = st
+		}
+	}
+	delete(s.stats, evictKey)
+
+	st := &userStats{
+		count:      evicted.count + 1,
+		errorCount: evicted.errorCount,
+		sumResp:    evicted.sumResp,
+		respCount:  evicted.respCount,
+	}
+	if isError {
+		st.errorCount++
+	}
+	if resp != nil {
+		st.sumResp += *resp
+		st.respCount++
+	}
+	s.stats[key] = st
+}
+
+// UserStat 是 top_users 列表中一个用户的汇总信息。
+type UserStat struct {
+	UserID                string  `json:"user_id"`
+	RequestCount          uint64  `json:"request_count"`
+	AverageResponseTimeMs float64 `json:"average_response_time_ms"`
+	ErrorRate             float64 `json:"error_rate"`
+}
+
+// TopN 返回按 count 降序排列的前 n 个监控 key。
+func (s *SpaceSaving) TopN(n int) []UserStat {
+	if n <= 0 || len(s.stats) == 0 {
+		return nil
+	}
+
+	out := make([]UserStat, 0, len(s.stats))
+	for k, st := range s.stats {
+		avg := 0.0
+		if st.respCount > 0 {
+			avg = st.sumResp / float64(st.respCount)
+		}
+		errRate := 0.0
+		if st.count > 0 {
+			errRate = float64(st.errorCount) / float64(st.count)
+		}
+		out = append(out, UserStat{
+			UserID:                k,
+			RequestCount:          st.count,
+			AverageResponseTimeMs: avg,
+			ErrorRate:             errRate,
+		})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].RequestCount != out[j].RequestCount {
+			return out[i].RequestCount > out[j].RequestCount
+		}
+		return out[i].UserID < out[j].UserID
+	})
+
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
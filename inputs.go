@@ -0,0 +1,127 @@
+// inputs.go
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// gzipMagic 是 gzip 流的前两个字节，用来在文件没有 .gz 后缀时也能识别出 gzip 内容。
+var gzipMagic = [2]byte{0x1f, 0x8b}
+
+// expandInputs 把命令行里的位置参数展开成具体的文件路径列表：
+// "-" 原样保留（代表 stdin），其余参数按 shell glob 展开；如果一个参数不是合法的
+// glob 或者没有匹配到任何文件，就原样保留它，让后续的 open 在找不到文件时报错，
+// 这样单个坏路径只会记录到 files_failed 而不会中止整个运行。
+func expandInputs(args []string) []string {
+	var out []string
+	for _, a := range args {
+		if a == "-" {
+			out = append(out, a)
+			continue
+		}
+		matches, err := filepath.Glob(a)
+		if err != nil || len(matches) == 0 {
+			out = append(out, a)
+			continue
+		}
+		sort.Strings(matches)
+		out = append(out, matches...)
+	}
+	return out
+}
+
+// readCloser 把一个 io.Reader 和一个独立的关闭函数粘合成 io.ReadCloser，
+// 用于在底层文件句柄之上套一层 gzip/zstd 解码器时，确保两者都能被正确关闭。
+type readCloser struct {
+	io.Reader
+	closeFn func() error
+}
+
+func (r readCloser) Close() error { return r.closeFn() }
+
+// openInput 打开一个输入源：path 为 "-" 时读 stdin；path 以 .gz/.zst 结尾，或者文件
+// 内容以 gzip 魔数开头时，透明地套上对应的解压 reader。
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	br := bufio.NewReader(f)
+	switch {
+	case strings.HasSuffix(path, ".zst"):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to open zstd stream: %w", err)
+		}
+		return readCloser{Reader: zr, closeFn: func() error {
+			zr.Close()
+			return f.Close()
+		}}, nil
+	case strings.HasSuffix(path, ".gz") || looksGzip(br):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to open gzip stream: %w", err)
+		}
+		return readCloser{Reader: gr, closeFn: func() error {
+			gerr := gr.Close()
+			ferr := f.Close()
+			if gerr != nil {
+				return gerr
+			}
+			return ferr
+		}}, nil
+	default:
+		return readCloser{Reader: br, closeFn: f.Close}, nil
+	}
+}
+
+// looksGzip 偷看流的头两个字节，判断它们是否是 gzip 魔数，不消费这些字节。
+func looksGzip(br *bufio.Reader) bool {
+	magic, err := br.Peek(2)
+	return err == nil && len(magic) == 2 && magic[0] == gzipMagic[0] && magic[1] == gzipMagic[1]
+}
+
+// readFile 打开 path（透明处理 gzip/zstd/stdin），逐行扫描并把每一行送入 lines channel，
+// 同时把读取的行数/字节数记到 Aggregator 的原子计数器上供 --progress reporter 使用。
+func readFile(path string, lines chan<- []byte, agg *Aggregator) error {
+	rc, err := openInput(path)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	scanner := bufio.NewScanner(rc)
+	// 扩大缓冲以支持较长行
+	buf := make([]byte, 0, 64*1024)
+	scanner.Buffer(buf, 16*1024*1024) // 16MB 上限
+
+	for scanner.Scan() {
+		raw := scanner.Bytes()
+		if len(raw) == 0 {
+			continue
+		}
+		// scanner 的 buffer 会复用，必须复制数据后再发送
+		cp := make([]byte, len(raw))
+		copy(cp, raw)
+		agg.linesProcessed.Add(1)
+		agg.bytesProcessed.Add(int64(len(raw)))
+		lines <- cp
+	}
+	return scanner.Err()
+}
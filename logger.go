@@ -1,31 +1,86 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/urfave/cli/v2"
 )
 
+// tdigestCompression 是每个 worker 本地 t-digest 的压缩参数，合并到 Aggregator 时沿用同一个值。
+const tdigestCompression = 100
+
+// digestMergeEvery 控制批处理模式（run）下 worker 多久把本地 t-digest 合并进 Aggregator
+// 一次：worker 退出前总会做最后一次合并，这里只是为了在超大文件上也能让 --progress
+// 期间的分位数不至于长期停留在上一批。serve 模式的 worker 长期运行、永不退出，
+// 不能依赖"退出前合并"，而是直接按 serveDigestMergeEvery 传入更小的合并节奏，
+// 见 newServer。
+const digestMergeEvery = 1000
+
+// serveDigestMergeEvery 是 serve 模式下 worker 合并本地 digest 的节奏：每处理一条
+// 响应时间样本就立即合并一次，这样 /metrics、/ws 快照才不会漏掉最近摄取但还没攒够
+// 一整批的数据（牺牲一点锁竞争换取实时性，serve 模式下这个代价可以接受）。
+const serveDigestMergeEvery = 1
+
 // LogEntry 对应日志行的字段
 type LogEntry struct {
 	Timestamp      string   `json:"timestamp"`
+	UserID         string   `json:"user_id"`
 	ResponseTimeMs *float64 `json:"response_time_ms"`
 	HTTPStatus     int      `json:"http_status"`
 }
 
 // Output 最终输出结构
 type Output struct {
-	TotalRequests         int            `json:"total_requests"`
-	AverageResponseTimeMs float64        `json:"average_response_time_ms"`
-	StatusCodeCounts      map[string]int `json:"status_code_counts"`
-	BusiestHour           *int           `json:"busiest_hour"`
+	TotalRequests         int                `json:"total_requests"`
+	AverageResponseTimeMs float64            `json:"average_response_time_ms"`
+	Percentiles           map[string]float64 `json:"percentiles,omitempty"`
+	StatusCodeCounts      map[string]int     `json:"status_code_counts"`
+	BusiestHour           *int               `json:"busiest_hour"`
+	TopUsers              []UserStat         `json:"top_users,omitempty"`
+	FilesFailed           []FileFailure      `json:"files_failed,omitempty"`
+
+	// 以下字段不参与默认的 json 格式输出，只是 --format=prom/ndjson-hourly 这些
+	// OutputWriter 实现在渲染各自格式时需要的额外素材。
+	HourCounts            [24]int           `json:"-"`
+	Hourly                []HourStat        `json:"-"`
+	ResponseTimeHistogram []HistogramBucket `json:"-"`
+	// ResponseTimeObservations/ResponseTimeSumMs 是直方图 +Inf 桶对应的真实观测数和
+	// 观测值之和（即 respCount/sumResp），必须和 ResponseTimeHistogram 的 +Inf 桶一致，
+	// 而不能用 TotalRequests/AverageResponseTimeMs 代替——后两者把没有 response_time_ms
+	// 的条目也算了进去。
+	ResponseTimeObservations int     `json:"-"`
+	ResponseTimeSumMs        float64 `json:"-"`
+}
+
+// FileFailure 记录一个无法被打开或读取的输入文件，以及失败原因。
+type FileFailure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// HourStat 是某一小时（0-23，按日志时间戳的小时计）的汇总信息，供 ndjson-hourly
+// 这类按小时拆分的输出格式使用。
+type HourStat struct {
+	Hour                  int                `json:"hour"`
+	TotalRequests         int                `json:"total_requests"`
+	AverageResponseTimeMs float64            `json:"average_response_time_ms"`
+	Percentiles           map[string]float64 `json:"percentiles,omitempty"`
+}
+
+// HistogramBucket 是一个累积分桶：Count 是响应时间小于等于 LE（"less than or equal"）
+// 毫秒的（近似）请求数，供 Prometheus/OpenMetrics 输出格式使用。
+type HistogramBucket struct {
+	LE    float64
+	Count uint64
 }
 
 // Aggregator 线程安全地聚合中间结果
@@ -36,15 +91,177 @@ type Aggregator struct {
 	respCount    int
 	statusCounts map[string]int
 	hourCounts   [24]int
+	hourSumResp  [24]float64
+	hourRespCnt  [24]int
+	digest       *TDigest
+	hourDigests  [24]*TDigest
+	topUsers     *SpaceSaving
+
+	// 以下计数器供 --progress reporter 读取，用原子操作维护以避免和 worker 池争抢 mu。
+	linesProcessed atomic.Int64
+	bytesProcessed atomic.Int64
+	invalidJSON    atomic.Int64
+}
+
+// spaceSavingCapacity 按照 Misra-Gries / Space-Saving 的惯例，监控槽位数取所需
+// top-N 的 10 倍（并设一个下限），在误差界和内存占用之间取得平衡。
+func spaceSavingCapacity(topN int) int {
+	cap := topN * 10
+	if cap < 1000 {
+		cap = 1000
+	}
+	return cap
 }
 
-func NewAggregator() *Aggregator {
-	return &Aggregator{
+// NewAggregator 创建一个新的 Aggregator。topN 为 0 时不追踪 per-user 统计。
+func NewAggregator(topN int) *Aggregator {
+	a := &Aggregator{
 		statusCounts: make(map[string]int),
+		digest:       NewTDigest(tdigestCompression),
+	}
+	for h := range a.hourDigests {
+		a.hourDigests[h] = NewTDigest(tdigestCompression)
+	}
+	if topN > 0 {
+		a.topUsers = NewSpaceSaving(spaceSavingCapacity(topN))
+	}
+	return a
+}
+
+// mergeDigest 在持锁的情况下把一个 worker 的本地 t-digest 并入全局 digest。
+// worker 在本地维护自己的 digest 以避免每条日志都去抢主锁，每攒够 mergeEvery 条样本
+// 以及退出前各合并一次（见 consumeLines）。
+func (a *Aggregator) mergeDigest(d *TDigest) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.digest.Merge(d)
+}
+
+// mergeHourDigests 和 mergeDigest 类似，但是按小时分别合并，供 worker 在同样的节奏下
+// 合并它本地维护的 24 个按小时切分的 t-digest。
+func (a *Aggregator) mergeHourDigests(hourDigests [24]*TDigest) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for h := 0; h < 24; h++ {
+		a.hourDigests[h].Merge(hourDigests[h])
+	}
+}
+
+// newHourDigests 创建 24 个空的 per-hour t-digest，供 worker 在本地累积样本。
+func newHourDigests() [24]*TDigest {
+	var out [24]*TDigest
+	for h := range out {
+		out[h] = NewTDigest(tdigestCompression)
+	}
+	return out
+}
+
+// consumeLines 是 worker 池的主循环：从 lines 读取日志行，解析后喂给 Add，并维护本地
+// 的全局 t-digest 和按小时切分的 t-digest，每处理 mergeEvery 条响应时间样本、
+// 以及 lines 关闭退出前各合并一次。run() 传入 digestMergeEvery 以降低批处理时的锁
+// 竞争；serve 模式的 worker 永不退出，由 newServer 传入 serveDigestMergeEvery（=1）
+// 让 /metrics、/ws 快照尽快看到新摄取的数据。
+func (a *Aggregator) consumeLines(id int, lines <-chan []byte, mergeEvery int) {
+	digest := NewTDigest(tdigestCompression)
+	hourDigests := newHourDigests()
+	sinceMerge := 0
+	for b := range lines {
+		var e LogEntry
+		if err := json.Unmarshal(b, &e); err != nil {
+			// 解析失败写 stderr（无法知道行号，这里不保存行号）
+			fmt.Fprintf(os.Stderr, "skip invalid json (worker %d): %v\n", id, err)
+			a.invalidJSON.Add(1)
+			continue
+		}
+		// 注意：无法传入精确行号到 worker，这里不严格依赖行号
+		hour, hasHour := a.Add(&e, 0)
+		if e.ResponseTimeMs != nil {
+			digest.Add(*e.ResponseTimeMs, 1)
+			if hasHour {
+				hourDigests[hour].Add(*e.ResponseTimeMs, 1)
+			}
+			sinceMerge++
+			if sinceMerge >= mergeEvery {
+				a.mergeDigest(digest)
+				a.mergeHourDigests(hourDigests)
+				digest = NewTDigest(tdigestCompression)
+				hourDigests = newHourDigests()
+				sinceMerge = 0
+			}
+		}
 	}
+	a.mergeDigest(digest)
+	a.mergeHourDigests(hourDigests)
 }
 
-func (a *Aggregator) Add(e *LogEntry, lineNo int) {
+// Snapshot 在不停止摄取的情况下返回当前聚合结果的一份快照：计数器在持锁期间拷贝
+// 出来，分位数和 top users 也在持锁期间求出，因此不会读到撕裂的中间状态；只有
+// busiest hour 是在锁外根据拷贝出的小时计数计算的。
+func (a *Aggregator) Snapshot(percentiles []float64, topN int) Output {
+	a.mu.Lock()
+	total := a.total
+	respCount := a.respCount
+	sumResp := a.sumResp
+	avg := 0.0
+	if respCount > 0 {
+		avg = sumResp / float64(respCount)
+	}
+	statusCounts := make(map[string]int, len(a.statusCounts))
+	for k, v := range a.statusCounts {
+		statusCounts[k] = v
+	}
+	hourCounts := a.hourCounts
+
+	var pct map[string]float64
+	if respCount > 0 {
+		pct = make(map[string]float64, len(percentiles))
+		for _, p := range percentiles {
+			key := fmt.Sprintf("p%g_response_time_ms", p)
+			pct[key] = a.digest.Quantile(p / 100)
+		}
+	}
+
+	var topUsersOut []UserStat
+	if a.topUsers != nil {
+		topUsersOut = a.topUsers.TopN(topN)
+	}
+	a.mu.Unlock()
+
+	var busiest *int
+	totalHourCounts := 0
+	for _, c := range hourCounts {
+		totalHourCounts += c
+	}
+	if totalHourCounts > 0 {
+		max := -1
+		best := 0
+		for h, c := range hourCounts {
+			if c > max {
+				max = c
+				best = h
+			}
+		}
+		busiest = new(int)
+		*busiest = best
+	}
+
+	return Output{
+		TotalRequests:            total,
+		AverageResponseTimeMs:    avg,
+		Percentiles:              pct,
+		StatusCodeCounts:         statusCounts,
+		BusiestHour:              busiest,
+		TopUsers:                 topUsersOut,
+		HourCounts:               hourCounts,
+		ResponseTimeObservations: respCount,
+		ResponseTimeSumMs:        sumResp,
+	}
+}
+
+// Add 把一条日志记录计入聚合结果。返回值 (hour, ok) 是该记录解析出的小时
+// （0-23），ok 为 false 表示时间戳缺失或无法解析；调用方用它来把响应时间样本
+// 同时喂给对应小时的本地 t-digest。
+func (a *Aggregator) Add(e *LogEntry, lineNo int) (hour int, ok bool) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
@@ -58,12 +275,21 @@ func (a *Aggregator) Add(e *LogEntry, lineNo int) {
 	statusKey := strconv.Itoa(e.HTTPStatus)
 	a.statusCounts[statusKey]++
 
+	if a.topUsers != nil && e.UserID != "" {
+		a.topUsers.Observe(e.UserID, e.HTTPStatus >= 500 && e.HTTPStatus < 600, e.ResponseTimeMs)
+	}
+
 	if e.Timestamp != "" {
 		// 解析 RFC3339 时间（兼容带 Z 或带偏移的 ISO8601）
 		if t, err := time.Parse(time.RFC3339, e.Timestamp); err == nil {
 			h := t.Hour()
 			if h >= 0 && h < 24 {
 				a.hourCounts[h]++
+				if e.ResponseTimeMs != nil {
+					a.hourSumResp[h] += *e.ResponseTimeMs
+					a.hourRespCnt[h]++
+				}
+				hour, ok = h, true
 			}
 		} else {
 			// 时间解析失败写到 stderr（不影响整体）
@@ -72,6 +298,64 @@ func (a *Aggregator) Add(e *LogEntry, lineNo int) {
 	} else {
 		fmt.Fprintf(os.Stderr, "warning: missing timestamp at line %d\n", lineNo)
 	}
+	return hour, ok
+}
+
+// HourCounts 返回按小时切分的请求计数快照。
+func (a *Aggregator) HourCounts() [24]int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.hourCounts
+}
+
+// HourlySnapshot 返回每个有数据的小时的汇总（总数、平均响应时间、分位数），
+// 用于 ndjson-hourly 这类按小时拆分的输出格式。
+func (a *Aggregator) HourlySnapshot(percentiles []float64) []HourStat {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var out []HourStat
+	for h := 0; h < 24; h++ {
+		if a.hourCounts[h] == 0 {
+			continue
+		}
+		avg := 0.0
+		if a.hourRespCnt[h] > 0 {
+			avg = a.hourSumResp[h] / float64(a.hourRespCnt[h])
+		}
+		var pct map[string]float64
+		if a.hourRespCnt[h] > 0 {
+			pct = make(map[string]float64, len(percentiles))
+			for _, p := range percentiles {
+				key := fmt.Sprintf("p%g_response_time_ms", p)
+				pct[key] = a.hourDigests[h].Quantile(p / 100)
+			}
+		}
+		out = append(out, HourStat{
+			Hour:                  h,
+			TotalRequests:         a.hourCounts[h],
+			AverageResponseTimeMs: avg,
+			Percentiles:           pct,
+		})
+	}
+	return out
+}
+
+// Histogram 把全局 t-digest 转换成一组累积分桶（le="..."），供 Prometheus 风格的
+// 直方图输出格式使用。bucketsMs 必须升序排列。
+func (a *Aggregator) Histogram(bucketsMs []float64) []HistogramBucket {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.respCount == 0 {
+		return nil
+	}
+	out := make([]HistogramBucket, 0, len(bucketsMs)+1)
+	for _, le := range bucketsMs {
+		out = append(out, HistogramBucket{LE: le, Count: uint64(a.digest.CDF(le) * float64(a.respCount))})
+	}
+	out = append(out, HistogramBucket{LE: math.Inf(1), Count: uint64(a.respCount)})
+	return out
 }
 
 func main() {
@@ -85,17 +369,107 @@ func main() {
 				Value:   4,
 				Usage:   "number of concurrent worker goroutines parsing lines",
 			},
+			&cli.StringFlag{
+				Name:  "percentiles",
+				Value: "50,95,99",
+				Usage: "comma-separated response-time percentiles to report (e.g. \"50,95,99\")",
+			},
+			&cli.IntFlag{
+				Name:  "top-users",
+				Value: 0,
+				Usage: "report the top N users by request count (0 disables per-user tracking)",
+			},
+			&cli.BoolFlag{
+				Name:  "progress",
+				Value: false,
+				Usage: "periodically print throughput/progress stats to stderr",
+			},
+			&cli.IntFlag{
+				Name:  "progress-interval",
+				Value: 5,
+				Usage: "seconds between --progress reports",
+			},
+			&cli.IntFlag{
+				Name:  "readers",
+				Value: 4,
+				Usage: "number of concurrent goroutines reading/decompressing input files",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Value: "json",
+				Usage: "output format: json, csv, prom, or ndjson-hourly",
+			},
+			&cli.StringFlag{
+				Name:  "csv-hours",
+				Usage: "with --format csv, also write the hour-of-day histogram to this path",
+			},
 		},
 		Action: func(c *cli.Context) error {
 			if c.NArg() < 1 {
-				return fmt.Errorf("usage: %s [--workers N] /path/to/access.log", c.App.Name)
+				return fmt.Errorf("usage: %s [--workers N] file.log [file2.log.gz ...] | -", c.App.Name)
 			}
-			path := c.Args().Get(0)
+			paths := expandInputs(c.Args().Slice())
 			workers := c.Int("workers")
 			if workers <= 0 {
 				workers = 1
 			}
-			return run(path, workers)
+			readers := c.Int("readers")
+			if readers <= 0 {
+				readers = 1
+			}
+			percentiles, err := parsePercentiles(c.String("percentiles"))
+			if err != nil {
+				return err
+			}
+			progressInterval := time.Duration(c.Int("progress-interval")) * time.Second
+			if progressInterval <= 0 {
+				progressInterval = time.Second
+			}
+			writer, err := getOutputWriter(c.String("format"))
+			if err != nil {
+				return err
+			}
+			return run(paths, workers, readers, percentiles, c.Int("top-users"), c.Bool("progress"), progressInterval, c.String("format"), writer, c.String("csv-hours"))
+		},
+		Commands: []*cli.Command{
+			{
+				Name:  "serve",
+				Usage: "start an HTTP server that ingests NDJSON and serves live aggregate snapshots",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "addr",
+						Value: ":8080",
+						Usage: "address to listen on",
+					},
+					&cli.IntFlag{
+						Name:    "workers",
+						Aliases: []string{"w"},
+						Value:   4,
+						Usage:   "number of concurrent worker goroutines parsing ingested lines",
+					},
+					&cli.StringFlag{
+						Name:  "percentiles",
+						Value: "50,95,99",
+						Usage: "comma-separated response-time percentiles to report (e.g. \"50,95,99\")",
+					},
+					&cli.IntFlag{
+						Name:  "top-users",
+						Value: 0,
+						Usage: "report the top N users by request count (0 disables per-user tracking)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					workers := c.Int("workers")
+					if workers <= 0 {
+						workers = 1
+					}
+					percentiles, err := parsePercentiles(c.String("percentiles"))
+					if err != nil {
+						return err
+					}
+					return serve(c.String("addr"), workers, percentiles, c.Int("top-users"))
+				},
+			},
 		},
 	}
 
@@ -104,98 +478,100 @@ func main() {
 	}
 }
 
-func run(path string, workers int) error {
-	f, err := os.Open(path)
-	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+// parsePercentiles 解析形如 "50,95,99" 的逗号分隔列表，返回 (0,100) 区间内的分位数值。
+func parsePercentiles(s string) ([]float64, error) {
+	var out []float64
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid percentile %q: %w", part, err)
+		}
+		if v <= 0 || v >= 100 {
+			return nil, fmt.Errorf("percentile %q out of range (0,100)", part)
+		}
+		out = append(out, v)
 	}
-	defer f.Close()
+	return out, nil
+}
 
-	scanner := bufio.NewScanner(f)
-	// 扩大缓冲以支持较长行
-	buf := make([]byte, 0, 64*1024)
-	scanner.Buffer(buf, 16*1024*1024) // 16MB 上限
+func run(paths []string, workers, readers int, percentiles []float64, topUsers int, progress bool, progressInterval time.Duration, format string, writer OutputWriter, csvHoursPath string) error {
+	if len(paths) == 0 {
+		return fmt.Errorf("no input files")
+	}
+	if readers > len(paths) {
+		readers = len(paths)
+	}
 
 	lines := make(chan []byte, 1024)
 	var wg sync.WaitGroup
-	agg := NewAggregator()
+	agg := NewAggregator(topUsers)
+
+	if progress {
+		done := make(chan struct{})
+		defer close(done)
+		go runProgressReporter(agg, progressInterval, os.Stderr, done)
+	}
 
 	// 启动 worker
 	for i := 0; i < workers; i++ {
 		wg.Add(1)
 		go func(id int) {
 			defer wg.Done()
-			for b := range lines {
-				var e LogEntry
-				if err := json.Unmarshal(b, &e); err != nil {
-					// 解析失败写 stderr（无法知道行号，这里不保存行号）
-					fmt.Fprintf(os.Stderr, "skip invalid json (worker %d): %v\n", id, err)
-					continue
-				}
-				// 注意：无法传入精确行号到 worker，这里不严格依赖行号
-				agg.Add(&e, 0)
-			}
+			agg.consumeLines(id, lines, digestMergeEvery)
 		}(i)
 	}
 
-	// 将行送入 channel（保留行号以便警告更精确）
-	lineNo := 0
-	for scanner.Scan() {
-		lineNo++
-		raw := scanner.Bytes()
-		if len(raw) == 0 {
-			continue
-		}
-		// scanner 的 buffer 会复用，必须复制数据后再发送
-		cp := make([]byte, len(raw))
-		copy(cp, raw)
-		lines <- cp
+	// 启动 reader 池：每个 reader 从 filePaths 取一个文件路径，透明解压后把行送入
+	// 和 worker 池共享的 lines channel，这样一批按天滚动压缩的日志可以一次处理完。
+	filePaths := make(chan string)
+	var failuresMu sync.Mutex
+	var failures []FileFailure
+
+	var readerWG sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		readerWG.Add(1)
+		go func() {
+			defer readerWG.Done()
+			for path := range filePaths {
+				if err := readFile(path, lines, agg); err != nil {
+					fmt.Fprintf(os.Stderr, "skip file %s: %v\n", path, err)
+					failuresMu.Lock()
+					failures = append(failures, FileFailure{Path: path, Error: err.Error()})
+					failuresMu.Unlock()
+				}
+			}
+		}()
 	}
-	if err := scanner.Err(); err != nil {
-		close(lines)
-		wg.Wait()
-		return fmt.Errorf("error scanning file: %w", err)
+	for _, p := range paths {
+		filePaths <- p
 	}
+	close(filePaths)
+	readerWG.Wait()
 
 	close(lines)
 	wg.Wait()
 
-	// 计算平均响应时间
-	avg := 0.0
-	if agg.respCount > 0 {
-		avg = agg.sumResp / float64(agg.respCount)
+	out := agg.Snapshot(percentiles, topUsers)
+	out.FilesFailed = failures
+	if format == "ndjson-hourly" {
+		out.Hourly = agg.HourlySnapshot(percentiles)
 	}
-
-	// 计算 busiest hour（若没有任何小时计数则为 nil）
-	var busiest *int
-	totalHourCounts := 0
-	for _, c := range agg.hourCounts {
-		totalHourCounts += c
-	}
-	if totalHourCounts > 0 {
-		max := -1
-		best := 0
-		for h, c := range agg.hourCounts {
-			if c > max {
-				max = c
-				best = h
-			}
-		}
-		busiest = new(int)
-		*busiest = best
+	if format == "prom" {
+		out.ResponseTimeHistogram = agg.Histogram(promHistogramBucketsMs)
 	}
 
-	out := Output{
-		TotalRequests:         agg.total,
-		AverageResponseTimeMs: avg,
-		StatusCodeCounts:      agg.statusCounts,
-		BusiestHour:           busiest,
+	if err := writer.WriteSummary(out, os.Stdout); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
 	}
 
-	enc := json.NewEncoder(os.Stdout)
-	enc.SetIndent("", "  ")
-	if err := enc.Encode(out); err != nil {
-		return fmt.Errorf("failed to encode output: %w", err)
+	if format == "csv" && csvHoursPath != "" {
+		if err := writeCSVHours(out.HourCounts, csvHoursPath); err != nil {
+			return fmt.Errorf("failed to write --csv-hours file: %w", err)
+		}
 	}
 
 	return nil
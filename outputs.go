@@ -0,0 +1,149 @@
+// outputs.go
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// promHistogramBucketsMs 是 --format prom 用来构建响应时间直方图的桶边界（单位毫秒）。
+var promHistogramBucketsMs = []float64{10, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// OutputWriter 把一份 Output 快照编码后写入 w。每种 --format 取值对应一个实现，
+// 通过 outputWriters 注册表按名字选择。
+type OutputWriter interface {
+	WriteSummary(out Output, w io.Writer) error
+}
+
+// outputWriters 是按 --format 名字索引的 OutputWriter 注册表。
+var outputWriters = map[string]OutputWriter{
+	"json":          jsonOutputWriter{},
+	"csv":           csvOutputWriter{},
+	"prom":          promOutputWriter{},
+	"ndjson-hourly": ndjsonHourlyOutputWriter{},
+}
+
+// getOutputWriter 按名字查找一个 OutputWriter，未知格式返回错误。
+func getOutputWriter(format string) (OutputWriter, error) {
+	w, ok := outputWriters[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+	return w, nil
+}
+
+// jsonOutputWriter 是默认格式：整份 Output 序列化成缩进 JSON，和这个工具历来的行为一致。
+type jsonOutputWriter struct{}
+
+func (jsonOutputWriter) WriteSummary(out Output, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// csvOutputWriter 为每个状态码输出一行 "status,count"。小时直方图不在这份 CSV 里，
+// 而是由 run() 在设置了 --csv-hours 时单独写到另一个文件（见 writeCSVHours）。
+type csvOutputWriter struct{}
+
+func (csvOutputWriter) WriteSummary(out Output, w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"status", "count"}); err != nil {
+		return err
+	}
+	for _, status := range sortedStatusKeys(out.StatusCodeCounts) {
+		if err := cw.Write([]string{status, strconv.Itoa(out.StatusCodeCounts[status])}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeCSVHours 把一个 24 小时的请求计数直方图写成 "hour,count" 的 CSV 文件。
+func writeCSVHours(hourCounts [24]int, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cw := csv.NewWriter(f)
+	if err := cw.Write([]string{"hour", "count"}); err != nil {
+		return err
+	}
+	for h, count := range hourCounts {
+		if err := cw.Write([]string{strconv.Itoa(h), strconv.Itoa(count)}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func sortedStatusKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// promOutputWriter 把 Output 编码成 Prometheus/OpenMetrics 文本暴露格式。
+type promOutputWriter struct{}
+
+func (promOutputWriter) WriteSummary(out Output, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintln(bw, "# HELP loganalyzer_requests_total Total number of requests by HTTP status code.")
+	fmt.Fprintln(bw, "# TYPE loganalyzer_requests_total counter")
+	for _, status := range sortedStatusKeys(out.StatusCodeCounts) {
+		fmt.Fprintf(bw, "loganalyzer_requests_total{status=%q} %d\n", status, out.StatusCodeCounts[status])
+	}
+
+	if len(out.ResponseTimeHistogram) > 0 {
+		fmt.Fprintln(bw, "# HELP loganalyzer_response_time_ms Response time distribution in milliseconds.")
+		fmt.Fprintln(bw, "# TYPE loganalyzer_response_time_ms histogram")
+		for _, b := range out.ResponseTimeHistogram {
+			le := "+Inf"
+			if !math.IsInf(b.LE, 1) {
+				le = strconv.FormatFloat(b.LE, 'g', -1, 64)
+			}
+			fmt.Fprintf(bw, "loganalyzer_response_time_ms_bucket{le=%q} %d\n", le, b.Count)
+		}
+		fmt.Fprintf(bw, "loganalyzer_response_time_ms_sum %s\n", strconv.FormatFloat(out.ResponseTimeSumMs, 'f', -1, 64))
+		fmt.Fprintf(bw, "loganalyzer_response_time_ms_count %d\n", out.ResponseTimeObservations)
+	}
+
+	fmt.Fprintln(bw, "# HELP loganalyzer_requests_by_hour Total number of requests observed in each hour-of-day bucket.")
+	fmt.Fprintln(bw, "# TYPE loganalyzer_requests_by_hour counter")
+	for h, count := range out.HourCounts {
+		if count == 0 {
+			continue
+		}
+		fmt.Fprintf(bw, "loganalyzer_requests_by_hour{hour=\"%d\"} %d\n", h, count)
+	}
+
+	return bw.Flush()
+}
+
+// ndjsonHourlyOutputWriter 输出一行一个 JSON 对象、每个有请求的小时一行（没有请求的小时不输出），每行带该小时的请求总数、
+// 平均响应时间和分位数，便于直接喂给按时间序列存储的下游系统。
+type ndjsonHourlyOutputWriter struct{}
+
+func (ndjsonHourlyOutputWriter) WriteSummary(out Output, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for _, hs := range out.Hourly {
+		if err := enc.Encode(hs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// progress.go
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"time"
+)
+
+// formatSI 把一个计数格式化为带 SI 后缀（k/M/G）的人类可读字符串，例如 1234567 -> "1.23M"。
+func formatSI(n float64) string {
+	abs := math.Abs(n)
+	switch {
+	case abs >= 1e9:
+		return fmt.Sprintf("%.2fG", n/1e9)
+	case abs >= 1e6:
+		return fmt.Sprintf("%.2fM", n/1e6)
+	case abs >= 1e3:
+		return fmt.Sprintf("%.2fk", n/1e3)
+	default:
+		return fmt.Sprintf("%.0f", n)
+	}
+}
+
+// formatBytes 把字节数格式化为带二进制后缀（KiB/MiB/GiB）的人类可读字符串。
+func formatBytes(n float64) string {
+	const (
+		kib = 1024
+		mib = kib * 1024
+		gib = mib * 1024
+	)
+	abs := math.Abs(n)
+	switch {
+	case abs >= gib:
+		return fmt.Sprintf("%.2fGiB", n/gib)
+	case abs >= mib:
+		return fmt.Sprintf("%.2fMiB", n/mib)
+	case abs >= kib:
+		return fmt.Sprintf("%.2fKiB", n/kib)
+	default:
+		return fmt.Sprintf("%.0fB", n)
+	}
+}
+
+// runProgressReporter 每隔 interval 向 out 打印一行累计 / 区间吞吐量统计，
+// 直到 done 被关闭。它只读取 Aggregator 上的原子计数器，不会和 worker 池争抢主锁。
+func runProgressReporter(agg *Aggregator, interval time.Duration, out io.Writer, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	start := time.Now()
+	lastTime := start
+	var lastLines, lastBytes int64
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			lines := agg.linesProcessed.Load()
+			bytesRead := agg.bytesProcessed.Load()
+			invalid := agg.invalidJSON.Load()
+
+			cumSecs := now.Sub(start).Seconds()
+			intervalSecs := now.Sub(lastTime).Seconds()
+
+			var mem runtime.MemStats
+			runtime.ReadMemStats(&mem)
+
+			fmt.Fprintf(out, "progress: lines=%s (%s/s cum, %s/s last) bytes=%s (%s/s cum, %s/s last) invalid_json=%s mem=%s\n",
+				formatSI(float64(lines)),
+				formatSI(perSecond(float64(lines), cumSecs)),
+				formatSI(perSecond(float64(lines-lastLines), intervalSecs)),
+				formatBytes(float64(bytesRead)),
+				formatBytes(perSecond(float64(bytesRead), cumSecs)),
+				formatBytes(perSecond(float64(bytesRead-lastBytes), intervalSecs)),
+				formatSI(float64(invalid)),
+				formatBytes(float64(mem.Alloc)),
+			)
+
+			lastTime = now
+			lastLines = lines
+			lastBytes = bytesRead
+		}
+	}
+}
+
+// perSecond 安全地计算速率，避免 elapsed 为 0 时除零。
+func perSecond(n, elapsedSecs float64) float64 {
+	if elapsedSecs <= 0 {
+		return 0
+	}
+	return n / elapsedSecs
+}
@@ -0,0 +1,127 @@
+// server.go
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsPushInterval 是 /ws 推送聚合快照的间隔。
+const wsPushInterval = time.Second
+
+// Server 承载 `serve` 子命令的运行时状态：一个常驻的 worker 池、喂给它们的 lines
+// channel，以及计算 /metrics、/ws 快照所需的配置。和批处理模式（run）不同，这里
+// worker 永远不会退出，摄取和读取快照是完全并发的。
+type Server struct {
+	agg         *Aggregator
+	lines       chan []byte
+	percentiles []float64
+	topUsers    int
+	upgrader    websocket.Upgrader
+}
+
+// newServer 创建一个 Server 并启动它的 worker 池。
+func newServer(workers int, percentiles []float64, topUsers int) *Server {
+	s := &Server{
+		agg:         NewAggregator(topUsers),
+		lines:       make(chan []byte, 1024),
+		percentiles: percentiles,
+		topUsers:    topUsers,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  4096,
+			WriteBufferSize: 4096,
+			// 这是一个本地指标收集工具，不对外暴露鉴权/跨域限制。
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+	for i := 0; i < workers; i++ {
+		go s.agg.consumeLines(i, s.lines, serveDigestMergeEvery)
+	}
+	return s
+}
+
+// serve 启动 HTTP 服务器，监听 addr，直到进程退出或 ListenAndServe 返回错误。
+func serve(addr string, workers int, percentiles []float64, topUsers int) error {
+	s := newServer(workers, percentiles, topUsers)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ingest", s.handleIngest)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/ws", s.handleWS)
+
+	fmt.Fprintf(os.Stderr, "loganalyzer serve: listening on %s\n", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// handleIngest 接受请求体中的 NDJSON，把每一行喂给和 batch 模式共享的 worker 池。
+func (s *Server) handleIngest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+
+	scanner := bufio.NewScanner(r.Body)
+	buf := make([]byte, 0, 64*1024)
+	scanner.Buffer(buf, 16*1024*1024) // 16MB 上限，和批处理模式保持一致
+
+	n := 0
+	for scanner.Scan() {
+		raw := scanner.Bytes()
+		if len(raw) == 0 {
+			continue
+		}
+		cp := make([]byte, len(raw))
+		copy(cp, raw)
+		s.agg.linesProcessed.Add(1)
+		s.agg.bytesProcessed.Add(int64(len(raw)))
+		s.lines <- cp
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		http.Error(w, fmt.Sprintf("error reading body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "ingested %d lines\n", n)
+}
+
+// handleMetrics 返回当前聚合结果的一份 JSON 快照。
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	snap := s.agg.Snapshot(s.percentiles, s.topUsers)
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(snap); err != nil {
+		log.Printf("failed to encode metrics: %v", err)
+	}
+}
+
+// handleWS 把连接升级为 WebSocket，此后每 wsPushInterval 推送一次最新的聚合快照，
+// 直到写入失败（通常意味着客户端已断开）。
+func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("ws upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	ticker := time.NewTicker(wsPushInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		snap := s.agg.Snapshot(s.percentiles, s.topUsers)
+		if err := conn.WriteJSON(snap); err != nil {
+			return
+		}
+	}
+}
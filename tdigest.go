@@ -0,0 +1,197 @@
+// tdigest.go
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// centroid 是 t-digest 内部的一个加权质心：mean 为该簇的均值，count 为落入该簇的样本权重之和。
+type centroid struct {
+	mean  float64
+	count float64
+}
+
+// TDigest 是一个近似分位数估计结构，用有限数量的质心来概括任意多的样本，
+// 从而在内存占用恒定的情况下支持对大流量日志计算 p50/p95/p99 等分位数。
+// compression 越大，质心越多、估计越精确，但内存占用也越高；典型取值在 100 左右。
+// TDigest 本身不是并发安全的：每个 worker 维护自己的 TDigest，最终通过 Merge 汇总。
+type TDigest struct {
+	compression float64
+	centroids   []centroid
+	count       float64
+	// sinceCompress 记录自上次重新压缩以来 Add 的次数，compress 时清零；是否触发
+	// shuffle 重建只看质心数量（见 Add），不看这个计数。
+	sinceCompress int
+}
+
+// NewTDigest 创建一个压缩参数为 compression 的空 t-digest。
+func NewTDigest(compression float64) *TDigest {
+	if compression <= 0 {
+		compression = 100
+	}
+	return &TDigest{compression: compression}
+}
+
+// Add 将一个带权重的样本点插入 digest。w 通常为 1（一次观测）。
+func (td *TDigest) Add(x, w float64) {
+	if w <= 0 {
+		return
+	}
+	if len(td.centroids) == 0 {
+		td.centroids = append(td.centroids, centroid{mean: x, count: w})
+		td.count += w
+		return
+	}
+
+	i := sort.Search(len(td.centroids), func(i int) bool { return td.centroids[i].mean >= x })
+	best := -1
+	bestDist := math.Inf(1)
+	for _, cand := range [2]int{i - 1, i} {
+		if cand < 0 || cand >= len(td.centroids) {
+			continue
+		}
+		d := math.Abs(td.centroids[cand].mean - x)
+		if d < bestDist {
+			bestDist = d
+			best = cand
+		}
+	}
+
+	if best >= 0 && td.canMerge(best, w) {
+		c := &td.centroids[best]
+		c.mean += (x - c.mean) * w / (c.count + w)
+		c.count += w
+	} else {
+		// 没有合适的邻居可以合并，新建一个质心并保持按 mean 排序。
+		td.centroids = append(td.centroids, centroid{})
+		copy(td.centroids[i+1:], td.centroids[i:])
+		td.centroids[i] = centroid{mean: x, count: w}
+	}
+	td.count += w
+
+	td.sinceCompress++
+	if len(td.centroids) > int(20*td.compression) {
+		td.compress()
+	}
+}
+
+// canMerge 判断下标为 idx 的质心是否还能再吸收权重 w，依据 t-digest 的分位数相关误差界：
+// 一个质心允许的最大权重与它所处的分位数 q 有关，q 越靠近 0 或 1（分布的尾部），
+// 允许的质心越小，从而让尾部（p95/p99 所在区域）获得更高的精度。
+func (td *TDigest) canMerge(idx int, w float64) bool {
+	c := td.centroids[idx]
+	cum := 0.0
+	for i := 0; i < idx; i++ {
+		cum += td.centroids[i].count
+	}
+	q := (cum + c.count/2) / td.count
+	limit := 4 * td.count * q * (1 - q) / td.compression
+	return c.count+w <= limit
+}
+
+// compress 周期性地打乱质心顺序并重新插入，缓解因为插入顺序造成的质心分布不均，
+// 这是原始 t-digest 论文中推荐的再平衡手段。
+func (td *TDigest) compress() {
+	old := td.centroids
+	rand.Shuffle(len(old), func(i, j int) { old[i], old[j] = old[j], old[i] })
+
+	fresh := NewTDigest(td.compression)
+	for _, c := range old {
+		fresh.Add(c.mean, c.count)
+	}
+	td.centroids = fresh.centroids
+	td.sinceCompress = 0
+}
+
+// CDF 返回落在 [-Inf, x] 内的样本比例（0 到 1 之间），是 Quantile 的逆运算，
+// 通过在质心间线性插值得到。对空 digest 返回 0。
+func (td *TDigest) CDF(x float64) float64 {
+	if len(td.centroids) == 0 || td.count <= 0 {
+		return 0
+	}
+	if x < td.centroids[0].mean {
+		return 0
+	}
+	if x >= td.centroids[len(td.centroids)-1].mean {
+		return 1
+	}
+
+	cum := 0.0
+	for i, c := range td.centroids {
+		if x < c.mean {
+			prev := td.centroids[i-1]
+			prevCum := cum - prev.count
+			lo := prevCum + prev.count/2
+			hi := cum + c.count/2
+			frac := 0.0
+			if c.mean > prev.mean {
+				frac = (x - prev.mean) / (c.mean - prev.mean)
+			}
+			return (lo + frac*(hi-lo)) / td.count
+		}
+		cum += c.count
+	}
+	return 1
+}
+
+// Merge 把 other 中的所有质心并入 td，用于把各 worker 的 per-goroutine digest 汇总进全局 digest。
+func (td *TDigest) Merge(other *TDigest) {
+	if other == nil || len(other.centroids) == 0 {
+		return
+	}
+	centroids := make([]centroid, len(other.centroids))
+	copy(centroids, other.centroids)
+	rand.Shuffle(len(centroids), func(i, j int) { centroids[i], centroids[j] = centroids[j], centroids[i] })
+	for _, c := range centroids {
+		td.Add(c.mean, c.count)
+	}
+}
+
+// Quantile 返回给定分位数 q（0<=q<=1）处的近似值，通过在质心间线性插值得到。
+// 对空 digest 返回 0。
+func (td *TDigest) Quantile(q float64) float64 {
+	if len(td.centroids) == 0 || td.count <= 0 {
+		return 0
+	}
+	if q <= 0 {
+		return td.centroids[0].mean
+	}
+	if q >= 1 {
+		return td.centroids[len(td.centroids)-1].mean
+	}
+	if len(td.centroids) == 1 {
+		return td.centroids[0].mean
+	}
+
+	target := q * td.count
+	cum := 0.0
+	for i, c := range td.centroids {
+		next := cum + c.count
+		if target <= next || i == len(td.centroids)-1 {
+			// 在当前质心与相邻质心之间线性插值。
+			if i == 0 {
+				return c.mean
+			}
+			prev := td.centroids[i-1]
+			prevCum := cum - prev.count
+			// 以两质心中点为界在 [prevCum+prev.count/2, cum+c.count/2] 之间插值。
+			lo := prevCum + prev.count/2
+			hi := cum + c.count/2
+			if hi <= lo {
+				return c.mean
+			}
+			frac := (target - lo) / (hi - lo)
+			if frac < 0 {
+				frac = 0
+			}
+			if frac > 1 {
+				frac = 1
+			}
+			return prev.mean + frac*(c.mean-prev.mean)
+		}
+		cum = next
+	}
+	return td.centroids[len(td.centroids)-1].mean
+}